@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configFileName is the config file looked up in the working directory.
+// When absent, defaultConfig() reproduces the tool's pre-config behavior.
+const configFileName = ".yml-helper-builder.toml"
+
+// Config describes a full migration rule set: what files to touch, what
+// header to prepend, and which rewrites to apply per workload kind.
+type Config struct {
+	Discover DiscoverConfig     `toml:"discover"`
+	Header   HeaderConfig       `toml:"header"`
+	Kinds    map[string]RuleSet `toml:"kinds"`
+}
+
+// DiscoverConfig selects which files are candidates for migration. Globs and
+// Excludes are doublestar patterns matched against the file path relative to
+// the scan root, e.g. "templates/**/{deployment,statefulset}.yaml".
+type DiscoverConfig struct {
+	Globs    []string `toml:"globs"`
+	Excludes []string `toml:"excludes"`
+}
+
+// RuleSet groups the rewrites and includes applied to documents of one
+// `kind:`. processFile dispatches to the RuleSet keyed by the document's
+// kind instead of hard-coding a per-kind switch.
+type RuleSet struct {
+	Rewrites RewritesConfig `toml:"rewrites"`
+	Includes []IncludeRule  `toml:"includes"`
+}
+
+// HeaderConfig controls the non-YAML template block prepended to each file.
+type HeaderConfig struct {
+	// Template is a printf-style string with a single %s for the detected base.
+	Template string `toml:"template"`
+	// Variables are extra literal `{{- $name := "value" -}}` lines inserted
+	// after the $base assignment, in addition to $base and $name.
+	Variables map[string]string `toml:"variables"`
+}
+
+// RewritesConfig groups the structural YAML rewrites.
+type RewritesConfig struct {
+	MetadataName MetadataNameRule `toml:"metadata_name"`
+	Labels       []LabelRule      `toml:"labels"`
+	Containers   []ContainerRule  `toml:"containers"`
+}
+
+// MetadataNameRule replaces metadata.name with Expr.
+type MetadataNameRule struct {
+	Expr string `toml:"expr"`
+}
+
+// LabelRule drops the given keys from the mapping at Path.
+type LabelRule struct {
+	Path []string `toml:"path"`
+	Drop []string `toml:"drop"`
+}
+
+// ContainerRule replaces a field on a JSONPath-like selector such as
+// "spec.template.spec.containers[0].name".
+type ContainerRule struct {
+	Path string `toml:"path"`
+	Expr string `toml:"expr"`
+}
+
+// IncludeRule injects Template (formatted with a single %d nindent arg)
+// below the mapping at Path.
+type IncludeRule struct {
+	Path     []string `toml:"path"`
+	Template string   `toml:"template"`
+	Nindent  int      `toml:"nindent"`
+}
+
+// defaultConfig reproduces the tool's behavior before configs existed, so
+// running without a .yml-helper-builder.toml is unchanged.
+func defaultConfig() Config {
+	labelPaths := [][]string{
+		{"metadata", "labels"},
+		{"spec", "template", "metadata", "labels"},
+	}
+	var labels []LabelRule
+	var includes []IncludeRule
+	for _, p := range labelPaths {
+		labels = append(labels, LabelRule{Path: p, Drop: []string{"app"}})
+		includes = append(includes, IncludeRule{Path: p, Template: includeSelector, Nindent: 0})
+	}
+
+	return Config{
+		Discover: DiscoverConfig{
+			Globs: []string{"templates/**/deployment.yaml"},
+		},
+		Header: HeaderConfig{
+			Template: headerBlockTmpl,
+		},
+		Kinds: map[string]RuleSet{
+			"Deployment": {
+				Rewrites: RewritesConfig{
+					MetadataName: MetadataNameRule{Expr: "{{ $name }}"},
+					Labels:       labels,
+					Containers: []ContainerRule{
+						{Path: "spec.template.spec.containers[0].name", Expr: "{{ $base }}"},
+					},
+				},
+				Includes: includes,
+			},
+		},
+	}
+}
+
+// targetKinds returns the kinds with a configured RuleSet, sorted for
+// deterministic error messages.
+func targetKinds(cfg Config) []string {
+	kinds := make([]string, 0, len(cfg.Kinds))
+	for k := range cfg.Kinds {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// loadConfig reads configFileName from dir, overlaying it onto
+// defaultConfig(). A missing file is not an error.
+//
+// The overlay is decoded into a separate, zero-valued Config rather than
+// straight into cfg: BurntSushi/toml replaces a map field wholesale for any
+// key present in the TOML rather than merging into it, so decoding directly
+// into cfg.Kinds would let a `[kinds.Deployment]` override that only sets
+// `includes` silently wipe out the default rewrites for Deployment. Instead
+// each overlaid kind is field-merged onto the existing (or zero) RuleSet via
+// mergeRuleSet, so a partial per-kind override only touches what it sets.
+func loadConfig(dir string) (Config, error) {
+	cfg := defaultConfig()
+	path := filepath.Join(dir, configFileName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return cfg, nil
+	}
+
+	var overlay Config
+	if _, err := toml.DecodeFile(path, &overlay); err != nil {
+		return Config{}, fmt.Errorf("decode %s: %w", path, err)
+	}
+
+	if overlay.Discover.Globs != nil {
+		cfg.Discover.Globs = overlay.Discover.Globs
+	}
+	if overlay.Discover.Excludes != nil {
+		cfg.Discover.Excludes = overlay.Discover.Excludes
+	}
+	if overlay.Header.Template != "" {
+		cfg.Header.Template = overlay.Header.Template
+	}
+	if overlay.Header.Variables != nil {
+		cfg.Header.Variables = overlay.Header.Variables
+	}
+	for kind, rules := range overlay.Kinds {
+		cfg.Kinds[kind] = mergeRuleSet(cfg.Kinds[kind], rules)
+	}
+	return cfg, nil
+}
+
+// mergeRuleSet overlays the fields overlay actually sets onto base, leaving
+// the rest of base untouched.
+func mergeRuleSet(base, overlay RuleSet) RuleSet {
+	if overlay.Rewrites.MetadataName.Expr != "" {
+		base.Rewrites.MetadataName.Expr = overlay.Rewrites.MetadataName.Expr
+	}
+	if overlay.Rewrites.Labels != nil {
+		base.Rewrites.Labels = overlay.Rewrites.Labels
+	}
+	if overlay.Rewrites.Containers != nil {
+		base.Rewrites.Containers = overlay.Rewrites.Containers
+	}
+	if overlay.Includes != nil {
+		base.Includes = overlay.Includes
+	}
+	return base
+}
+
+// renderHeader formats h.Template with base and splices in any configured
+// extra variables right after the $base assignment.
+func renderHeader(h HeaderConfig, base string) string {
+	out := fmt.Sprintf(h.Template, base)
+	if len(h.Variables) == 0 {
+		return out
+	}
+	names := make([]string, 0, len(h.Variables))
+	for k := range h.Variables {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var extra strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&extra, "{{- $%s := %q -}}\n", k, h.Variables[k])
+	}
+
+	nl := strings.Index(out, "\n")
+	if nl < 0 {
+		return out + extra.String()
+	}
+	return out[:nl+1] + extra.String() + out[nl+1:]
+}
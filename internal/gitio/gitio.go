@@ -0,0 +1,97 @@
+// Package gitio wraps the go-git operations the migrator needs in --git
+// mode: detecting uncommitted changes and committing the files it rewrote.
+package gitio
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Repo is a thin wrapper around a go-git repository and its worktree,
+// scoped to absolute paths so callers don't need to track repo-relative
+// ones themselves.
+type Repo struct {
+	repo *git.Repository
+	wt   *git.Worktree
+}
+
+// Open opens the git repository enclosing dir.
+func Open(dir string) (*Repo, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, fmt.Errorf("open repo at %s: %w", dir, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("get worktree: %w", err)
+	}
+	return &Repo{repo: repo, wt: wt}, nil
+}
+
+// DirtyFiles returns the subset of paths that have uncommitted staged or
+// unstaged modifications.
+func (r *Repo) DirtyFiles(paths []string) ([]string, error) {
+	status, err := r.wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("status: %w", err)
+	}
+	root := r.wt.Filesystem.Root()
+
+	var dirty []string
+	for _, p := range paths {
+		rel, err := relTo(root, p)
+		if err != nil {
+			return nil, fmt.Errorf("relativize %s: %w", p, err)
+		}
+		if s, ok := status[rel]; ok && (s.Staging != git.Unmodified || s.Worktree != git.Unmodified) {
+			dirty = append(dirty, p)
+		}
+	}
+	return dirty, nil
+}
+
+// StageAndCommit adds paths to the index and commits them with message.
+func (r *Repo) StageAndCommit(paths []string, message string) (plumbing.Hash, error) {
+	root := r.wt.Filesystem.Root()
+	for _, p := range paths {
+		rel, err := relTo(root, p)
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("relativize %s: %w", p, err)
+		}
+		if _, err := r.wt.Add(rel); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("stage %s: %w", p, err)
+		}
+	}
+
+	hash, err := r.wt.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "yml-helper-builder", When: time.Now()},
+	})
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("commit: %w", err)
+	}
+	return hash, nil
+}
+
+// relTo returns p's slash-separated path relative to root. root is always
+// absolute (it comes from the worktree filesystem), but callers may pass p
+// relative to their own working directory rather than to root, so p is
+// absolutized against the process's cwd first when it isn't already.
+func relTo(root, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return "", err
+		}
+		p = abs
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
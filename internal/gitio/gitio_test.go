@@ -0,0 +1,143 @@
+package gitio
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// newTestRepo builds an in-memory repository with a single committed file
+// "clean.yaml" and an uncommitted "dirty.yaml", returning a Repo wired
+// straight to its worktree (no disk, no gitio.Open).
+func newTestRepo(t *testing.T) *Repo {
+	t.Helper()
+
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatalf("init repo: %v", err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatalf("worktree: %v", err)
+	}
+
+	if err := util.WriteFile(fs, "clean.yaml", []byte("a: 1\n"), 0644); err != nil {
+		t.Fatalf("write clean.yaml: %v", err)
+	}
+	if _, err := wt.Add("clean.yaml"); err != nil {
+		t.Fatalf("stage clean.yaml: %v", err)
+	}
+	sig := &object.Signature{Name: "test", When: time.Now()}
+	if _, err := wt.Commit("baseline", &git.CommitOptions{Author: sig}); err != nil {
+		t.Fatalf("baseline commit: %v", err)
+	}
+
+	if err := util.WriteFile(fs, "dirty.yaml", []byte("b: 1\n"), 0644); err != nil {
+		t.Fatalf("write dirty.yaml: %v", err)
+	}
+
+	return &Repo{repo: repo, wt: wt}
+}
+
+func TestDirtyFiles(t *testing.T) {
+	r := newTestRepo(t)
+
+	dirty, err := r.DirtyFiles([]string{"/clean.yaml", "/dirty.yaml"})
+	if err != nil {
+		t.Fatalf("DirtyFiles: %v", err)
+	}
+	if len(dirty) != 1 || dirty[0] != "/dirty.yaml" {
+		t.Fatalf("DirtyFiles = %v, want [/dirty.yaml]", dirty)
+	}
+}
+
+func TestStageAndCommit(t *testing.T) {
+	r := newTestRepo(t)
+
+	hash, err := r.StageAndCommit([]string{"/dirty.yaml"}, "migrate dirty.yaml")
+	if err != nil {
+		t.Fatalf("StageAndCommit: %v", err)
+	}
+	if hash.IsZero() {
+		t.Fatal("StageAndCommit returned a zero hash")
+	}
+
+	dirty, err := r.DirtyFiles([]string{"/clean.yaml", "/dirty.yaml"})
+	if err != nil {
+		t.Fatalf("DirtyFiles after commit: %v", err)
+	}
+	if len(dirty) != 0 {
+		t.Fatalf("DirtyFiles after commit = %v, want none", dirty)
+	}
+
+	commit, err := r.repo.CommitObject(hash)
+	if err != nil {
+		t.Fatalf("CommitObject: %v", err)
+	}
+	if commit.Message != "migrate dirty.yaml" {
+		t.Fatalf("commit message = %q, want %q", commit.Message, "migrate dirty.yaml")
+	}
+}
+
+// TestOnDiskRelativePaths exercises Open against a real on-disk repo the way
+// the CLI actually calls it: gitio.Open(".") from the repo root, then
+// DirtyFiles/StageAndCommit with the relative paths discoverFiles returns
+// (e.g. "templates/deployment.yaml"), not the absolute ones the in-memory
+// tests above use.
+func TestOnDiskRelativePaths(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := git.PlainInit(dir, false); err != nil {
+		t.Fatalf("PlainInit: %v", err)
+	}
+
+	rel := filepath.Join("templates", "deployment.yaml")
+	abs := filepath.Join(dir, rel)
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(abs, []byte("a: 1\n"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+
+	r, err := Open(".")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	dirty, err := r.DirtyFiles([]string{rel})
+	if err != nil {
+		t.Fatalf("DirtyFiles: %v", err)
+	}
+	if len(dirty) != 1 || dirty[0] != rel {
+		t.Fatalf("DirtyFiles = %v, want [%s]", dirty, rel)
+	}
+
+	if _, err := r.StageAndCommit([]string{rel}, "migrate deployment.yaml"); err != nil {
+		t.Fatalf("StageAndCommit: %v", err)
+	}
+
+	dirty, err = r.DirtyFiles([]string{rel})
+	if err != nil {
+		t.Fatalf("DirtyFiles after commit: %v", err)
+	}
+	if len(dirty) != 0 {
+		t.Fatalf("DirtyFiles after commit = %v, want none", dirty)
+	}
+}
@@ -1,15 +1,24 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/pmezard/go-difflib/difflib"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"pedro-git-projects/yml-helper-builder/internal/gitio"
 )
 
 const (
@@ -21,14 +30,92 @@ const (
 `
 )
 
-// keyCtx tracks YAML key path + indent while scanning.
-type keyCtx struct {
-	indent int
-	key    string
-}
+// globList is a flag.Value collecting repeated --include/--exclude flags.
+type globList []string
+
+func (g *globList) String() string     { return strings.Join(*g, ",") }
+func (g *globList) Set(v string) error { *g = append(*g, v); return nil }
 
 func main() {
+	var includes, excludes globList
+	watch := flag.Bool("watch", false, "after the initial pass, re-run on changes to matched files or the config")
+	gitMode := flag.Bool("git", false, "stage and commit migrated files via git instead of writing .bak files")
+	force := flag.Bool("force", false, "with --git, proceed even if target files have uncommitted changes")
+	dryRun := flag.Bool("dry-run", false, "compute changes in-memory and report them without touching the filesystem")
+	format := flag.String("format", "text", `--dry-run output format: "text" (unified diff per file) or "json" (per-file rewrite summary)`)
+	flag.Var(&includes, "include", "glob pattern of files to migrate (repeatable; overrides discover.globs)")
+	flag.Var(&excludes, "exclude", "glob pattern of files to skip (repeatable; added to discover.excludes)")
+	flag.Parse()
+
 	root := "."
+	cfg, err := loadConfig(root)
+	must(err)
+	if len(includes) > 0 {
+		cfg.Discover.Globs = includes
+	}
+	cfg.Discover.Excludes = append(cfg.Discover.Excludes, excludes...)
+
+	files, err := discoverFiles(root, cfg.Discover)
+	must(err)
+
+	if len(files) == 0 {
+		fmt.Println("no files matched discover.globs")
+		return
+	}
+
+	if *dryRun {
+		if err := runDryRun(files, cfg, *format); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	writeBackup := true
+	var repo *gitio.Repo
+	if *gitMode {
+		r, err := gitio.Open(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "git mode disabled, falling back to .bak files: %v\n", err)
+		} else {
+			if !*force {
+				dirty, err := r.DirtyFiles(files)
+				must(err)
+				if len(dirty) > 0 {
+					fmt.Fprintf(os.Stderr, "refusing to run: uncommitted changes in %s (use --force)\n", strings.Join(dirty, ", "))
+					os.Exit(1)
+				}
+			}
+			repo = r
+			writeBackup = false
+		}
+	}
+
+	var changed []string
+	for _, f := range files {
+		if err := processFile(f, cfg, writeBackup); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR %s: %v\n", f, err)
+			continue
+		}
+		fmt.Printf("updated %s\n", f)
+		changed = append(changed, f)
+	}
+
+	if repo != nil && len(changed) > 0 {
+		msg := fmt.Sprintf("chore(helm): migrate %d deployment.yaml to auki helpers", len(changed))
+		if _, err := repo.StageAndCommit(changed, msg); err != nil {
+			fmt.Fprintf(os.Stderr, "git commit failed: %v\n", err)
+		}
+	}
+
+	if *watch {
+		must(runWatch(root, cfg))
+	}
+}
+
+// discoverFiles walks root, returning paths matching any of cfg.Globs and
+// none of cfg.Excludes.
+func discoverFiles(root string, cfg DiscoverConfig) ([]string, error) {
 	var files []string
 	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -37,283 +124,378 @@ func main() {
 		if d.IsDir() {
 			return nil
 		}
-		if filepath.Base(path) == "deployment.yaml" &&
-			strings.Contains(path, string(filepath.Separator)+"templates"+string(filepath.Separator)) {
-			files = append(files, path)
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !matchesAny(cfg.Globs, rel) || matchesAny(cfg.Excludes, rel) {
+			return nil
 		}
+		files = append(files, path)
 		return nil
 	})
-	must(err)
-
-	if len(files) == 0 {
-		fmt.Println("no templates/**/deployment.yaml files found")
-		return
-	}
+	return files, err
+}
 
-	for _, f := range files {
-		if err := processFile(f); err != nil {
-			fmt.Fprintf(os.Stderr, "ERROR %s: %v\n", f, err)
-		} else {
-			fmt.Printf("updated %s\n", f)
+// matchesAny reports whether path matches any of the doublestar globs.
+func matchesAny(globs []string, path string) bool {
+	for _, g := range globs {
+		if ok, _ := doublestar.Match(g, path); ok {
+			return true
 		}
 	}
+	return false
+}
+
+// RewriteSummary records which rewrites fired for one file, independent of
+// whether the result was actually written to disk. Error is set instead of
+// the rewrite fields when buildFile couldn't process the file at all.
+type RewriteSummary struct {
+	File              string `json:"file"`
+	Changed           bool   `json:"changed"`
+	HeaderInserted    bool   `json:"headerInserted"`
+	NameRewritten     bool   `json:"nameRewritten"`
+	LabelsDropped     int    `json:"labelsDropped"`
+	ContainersRenamed int    `json:"containersRenamed"`
+	SelectorsInjected []int  `json:"selectorsInjected"` // nindent of each injection
+	Error             string `json:"error,omitempty"`
 }
 
-func processFile(path string) error {
-	orig, err := os.ReadFile(path)
+// buildFile computes the migrated contents of path in memory, without
+// writing anything. YAML documents are parsed and rewritten with kyaml so
+// flow mappings, multi-line scalars, and anchors round-trip safely; the
+// helper header isn't valid YAML on its own and is still handled as a
+// string prepend before the document pipeline runs.
+//
+// Once migrated, a file's body contains bare templating tokens (e.g.
+// "name: {{ $name }}") that are valid Helm output but not valid YAML on
+// their own (an unquoted "{{" opens a flow mapping), so there's nothing
+// left for a second kyaml pass to safely do. hasHeader detects that case
+// from the presence of the prepended header, and buildFile treats it as a
+// no-op instead of re-parsing the body, which is what keeps re-running on
+// an already-migrated file safe rather than a hard parser crash.
+//
+// kyaml preserves comments and key ordering, but it does not preserve the
+// original document's indentation and spacing outside the fields this tool
+// actually touches, so a first-time migration can carry unrelated
+// reformatting noise (e.g. re-indented sequence items) beyond the targeted
+// change.
+func buildFile(path string, cfg Config) (orig []byte, out string, summary RewriteSummary, err error) {
+	summary.File = path
+
+	orig, err = os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, "", summary, err
 	}
 	content := string(orig)
 
-	// If already migrated (header present), still run replacements safely.
-	hasHeader := strings.Contains(content, `include "auki.nameFor"`)
+	if hasHeader(content) {
+		summary.Changed = false
+		return orig, content, summary, nil
+	}
 
-	base, err := detectBaseFromTopMetadataName(content)
+	base, err := detectBase(content, targetKinds(cfg))
 	if err != nil {
-		return fmt.Errorf("detect base: %w", err)
+		return nil, "", summary, fmt.Errorf("detect base: %w", err)
 	}
 	if strings.HasSuffix(base, "-green") {
 		base = strings.TrimSuffix(base, "-green")
 	}
 
-	lines := splitKeepNL(content)
+	nodes, err := (&kio.ByteReader{Reader: strings.NewReader(content)}).Read()
+	if err != nil {
+		return nil, "", summary, fmt.Errorf("parse yaml: %w", err)
+	}
 
-	kind := "" // track current document kind
-	var stack []keyCtx
+	var injected []IncludeRule
+	for _, doc := range nodes {
+		kindNode, err := doc.Pipe(yaml.Lookup("kind"))
+		if err != nil {
+			return nil, "", summary, err
+		}
+		if kindNode == nil {
+			continue
+		}
+		rules, ok := cfg.Kinds[kindNode.YNode().Value]
+		if !ok {
+			continue
+		}
 
-	var buf bytes.Buffer
-	sc := newScanner(lines)
-
-	insertedHeader := false
-	if !hasHeader {
-		buf.WriteString(fmt.Sprintf(headerBlockTmpl, base)) // insert header at top
-		insertedHeader = true
-	}
-
-	// Patterns
-	reKey := regexp.MustCompile(`^(\s*)([A-Za-z0-9_.-]+):(?:\s*(.*))?$`)
-	reKind := regexp.MustCompile(`^\s*kind:\s*([A-Za-z0-9]+)\s*$`)
-	reNameKV := regexp.MustCompile(`^\s*name:\s*(.+?)\s*$`)
-	reDashName := regexp.MustCompile(`^(\s*)-\s*name:\s*(.+?)\s*$`)
-	reIncludeSelector := regexp.MustCompile(`include +"auki\.selectorLabelsFor"`)
-
-	type blockState int
-	const (
-		none blockState = iota
-		inTopMetadata
-		inTopLabels
-		inTemplateMetadata
-		inTemplateLabels
-		inContainersList
-	)
-
-	state := none
-	topMetaIndent := -1
-	labelsIndent := -1
-	tplLabelsIndent := -1
-
-	for sc.Scan() {
-		line := sc.Text()
-
-		// Track kind across docs
-		if m := reKind.FindStringSubmatch(line); m != nil {
-			kind = m[1]
-		}
-
-		// Update indent/key stack
-		if m := reKey.FindStringSubmatch(line); m != nil {
-			indent := len(m[1])
-			key := m[2]
-			val := m[3]
-
-			for len(stack) > 0 && indent <= stack[len(stack)-1].indent {
-				stack = stack[:len(stack)-1]
-			}
-			stack = append(stack, keyCtx{indent: indent, key: key})
-
-			p := pathOf(stack)
-
-			// state transitions (only for Deployment)
-			if kind == "Deployment" {
-				switch {
-				case p == "metadata" && val == "":
-					state = inTopMetadata
-					topMetaIndent = indent
-				case state == inTopMetadata && key == "labels" && val == "":
-					state = inTopLabels
-					labelsIndent = indent
-				case p == "spec.template.metadata" && val == "":
-					state = inTemplateMetadata
-				case state == inTemplateMetadata && key == "labels" && val == "":
-					state = inTemplateLabels
-					tplLabelsIndent = indent
-				case p == "spec.template.spec.containers" && val == "":
-					state = inContainersList
-				}
+		if err := doc.PipeE(&MetadataNameFilter{Name: rules.Rewrites.MetadataName.Expr}); err != nil {
+			return nil, "", summary, fmt.Errorf("rewrite metadata.name: %w", err)
+		}
+		summary.NameRewritten = true
+
+		for _, c := range rules.Rewrites.Containers {
+			renamed, err := applyContainerRule(doc, c)
+			if err != nil {
+				return nil, "", summary, fmt.Errorf("rewrite container %s: %w", c.Path, err)
 			}
-		} else {
-			// Handle closing of blocks by indent decrease
-			curIndent := countIndent(line)
-			switch state {
-			case inTopLabels:
-				if curIndent <= labelsIndent {
-					buf = ensureSelectorInclude(buf, labelsIndent+2, reIncludeSelector)
-					state = inTopMetadata
-				}
-			case inTemplateLabels:
-				if curIndent <= tplLabelsIndent {
-					buf = ensureSelectorInclude(buf, tplLabelsIndent+2, reIncludeSelector)
-					state = inTemplateMetadata
-				}
+			if renamed {
+				summary.ContainersRenamed++
 			}
-			for len(stack) > 0 && curIndent <= stack[len(stack)-1].indent {
-				stack = stack[:len(stack)-1]
+		}
+		for _, l := range rules.Rewrites.Labels {
+			n, err := (&DropLabelsFilter{Keys: l.Drop}).applyAt(doc, l.Path)
+			if err != nil {
+				return nil, "", summary, fmt.Errorf("drop labels at %s: %w", strings.Join(l.Path, "."), err)
 			}
+			summary.LabelsDropped += n
 		}
+		injected = append(injected, rules.Includes...)
+	}
 
-		// Rewrites
-		switch {
-		// metadata.name -> {{ $name }}
-		case kind == "Deployment" && state == inTopMetadata &&
-			reNameKV.MatchString(strings.TrimLeft(line, " ")) &&
-			leadingSpaces(line) == topMetaIndent+2:
-			buf.WriteString(spaces(topMetaIndent+2) + "name: {{ $name }}\n")
-			continue
+	var buf bytes.Buffer
+	writer := &kio.ByteWriter{Writer: &buf}
+	if err := writer.Write(nodes); err != nil {
+		return nil, "", summary, fmt.Errorf("render yaml: %w", err)
+	}
 
-		// metadata.labels: drop app: ...
-		case kind == "Deployment" && state == inTopLabels && isAppLabelLine(line, labelsIndent+2):
-			continue
+	out = stripTemplateQuotes(buf.String())
+	for _, inc := range injected {
+		rendered, nindent, didInject := (&SelectorIncludeFilter{Path: inc.Path, Template: inc.Template, Nindent: inc.Nindent}).inject(out)
+		out = rendered
+		if didInject {
+			summary.SelectorsInjected = append(summary.SelectorsInjected, nindent)
+		}
+	}
 
-		// spec.template.metadata.labels: drop app: ...
-		case kind == "Deployment" && state == inTemplateLabels && isAppLabelLine(line, tplLabelsIndent+2):
-			continue
+	out = renderHeader(cfg.Header, base) + out
+	summary.HeaderInserted = true
 
-		// containers: first item name -> {{ $base }}
-		case kind == "Deployment" && state == inContainersList && reDashName.MatchString(line):
-			m := reDashName.FindStringSubmatch(line)
-			indent := m[1]
-			buf.WriteString(fmt.Sprintf("%s- name: {{ $base }}\n", indent))
-			continue
+	summary.Changed = out != content
+	return orig, out, summary, nil
+}
+
+// processFile rewrites a single manifest file in place. When
+// writeBackup is true, the original is preserved alongside it as path+".bak";
+// in --git mode the caller sets this to false since git diff/checkout cover
+// recovery.
+func processFile(path string, cfg Config, writeBackup bool) error {
+	orig, out, _, err := buildFile(path, cfg)
+	if err != nil {
+		return err
+	}
+	if writeBackup {
+		if err := os.WriteFile(path+".bak", orig, 0644); err != nil {
+			return fmt.Errorf("write backup: %w", err)
 		}
+	}
+	if err := os.WriteFile(path, []byte(out), 0644); err != nil {
+		return fmt.Errorf("write updated: %w", err)
+	}
+	return nil
+}
+
+// MetadataNameFilter rewrites metadata.name to a literal, unquoted scalar.
+type MetadataNameFilter struct {
+	Name string
+}
+
+func (f *MetadataNameFilter) Filter(object *yaml.RNode) (*yaml.RNode, error) {
+	return object.Pipe(yaml.LookupCreate(yaml.ScalarNode, "metadata", "name"), yaml.FieldSetter{
+		Value: noQuoteScalar(f.Name),
+	})
+}
+
+// ContainerNameFilter rewrites the name field of the container at Index in
+// the sequence at Path to a literal, unquoted scalar.
+type ContainerNameFilter struct {
+	Path  []string
+	Index int
+	Name  string
+}
 
-		// default: copy original line
-		buf.WriteString(line)
+// Filter renames the container and reports whether it found one to rename.
+func (f *ContainerNameFilter) Filter(object *yaml.RNode) (renamed bool, err error) {
+	containers, err := object.Pipe(yaml.Lookup(f.Path...))
+	if err != nil || containers == nil {
+		return false, err
+	}
+	elements, err := containers.Elements()
+	if err != nil || len(elements) <= f.Index {
+		return false, err
+	}
+	if _, err := elements[f.Index].Pipe(yaml.LookupCreate(yaml.ScalarNode, "name"), yaml.FieldSetter{
+		Value: noQuoteScalar(f.Name),
+	}); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	if err := sc.Err(); err != nil {
-		return err
+// applyContainerRule resolves a ContainerRule's JSONPath-like selector
+// (e.g. "spec.template.spec.containers[0].name") and applies it via
+// ContainerNameFilter, reporting whether a container was renamed.
+func applyContainerRule(object *yaml.RNode, rule ContainerRule) (bool, error) {
+	path, index, field, err := parseContainerPath(rule.Path)
+	if err != nil {
+		return false, err
 	}
+	if field != "name" {
+		return false, fmt.Errorf("unsupported container field %q", field)
+	}
+	return (&ContainerNameFilter{Path: path, Index: index, Name: rule.Expr}).Filter(object)
+}
 
-	// If file ended inside a labels block, inject include.
-	if state == inTopLabels {
-		buf = ensureSelectorInclude(buf, labelsIndent+2, regexp.MustCompile(`include +"auki\.selectorLabelsFor"`))
+// parseContainerPath splits "a.b.c[N].field" into ([a b c], N, "field").
+func parseContainerPath(p string) (path []string, index int, field string, err error) {
+	parts := strings.Split(p, ".")
+	if len(parts) < 2 {
+		return nil, 0, "", fmt.Errorf("invalid container path %q", p)
 	}
-	if state == inTemplateLabels {
-		buf = ensureSelectorInclude(buf, tplLabelsIndent+2, regexp.MustCompile(`include +"auki\.selectorLabelsFor"`))
+	field = parts[len(parts)-1]
+	indexed := parts[len(parts)-2]
+	open, closeIdx := strings.Index(indexed, "["), strings.Index(indexed, "]")
+	if open < 0 || closeIdx < open {
+		return nil, 0, "", fmt.Errorf("invalid container path %q: expected [N] index", p)
 	}
+	index, err = strconv.Atoi(indexed[open+1 : closeIdx])
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("invalid container index in %q: %w", p, err)
+	}
+	path = append(append([]string{}, parts[:len(parts)-2]...), indexed[:open])
+	return path, index, field, nil
+}
 
-	out := buf.String()
+// DropLabelsFilter removes the given keys from a labels mapping.
+type DropLabelsFilter struct {
+	Keys []string
+}
 
-	// Avoid double header if somehow present twice
-	if insertedHeader && strings.Count(out, `include "auki.nameFor"`) > 1 {
-		parts := strings.SplitN(out, `{{- $name := include "auki.nameFor" (dict "ctx" $ctx "base" $base) -}}`, 2)
-		if len(parts) == 2 {
-			after := strings.SplitN(parts[1], "\n", 2)
-			if len(after) == 2 {
-				out = parts[0] + `{{- $name := include "auki.nameFor" (dict "ctx" $ctx "base" $base) -}}` + "\n" + after[1]
-			}
+// applyAt drops f.Keys found in the mapping at path, returning how many
+// were actually present and dropped.
+func (f *DropLabelsFilter) applyAt(object *yaml.RNode, path []string) (dropped int, err error) {
+	labels, err := object.Pipe(yaml.Lookup(path...))
+	if err != nil || labels == nil {
+		return 0, err
+	}
+	for _, key := range f.Keys {
+		val, err := labels.Pipe(yaml.Lookup(key))
+		if err != nil {
+			return dropped, err
+		}
+		if val == nil {
+			continue
 		}
+		if err := labels.PipeE(yaml.Clear(key)); err != nil {
+			return dropped, err
+		}
+		dropped++
 	}
+	return dropped, nil
+}
 
-	// Write back (with .bak)
-	backup := path + ".bak"
-	if err := os.WriteFile(backup, orig, 0644); err != nil {
-		return fmt.Errorf("write backup: %w", err)
-	}
-	if err := os.WriteFile(path, []byte(out), 0644); err != nil {
-		return fmt.Errorf("write updated: %w", err)
-	}
-	return nil
+// SelectorIncludeFilter injects Template (formatted with a single %d
+// nindent arg, or used verbatim if it has none) below a labels block. The
+// include directive isn't valid standalone YAML (it has no key), so
+// injection happens as a string splice keyed off the block's rendered
+// indent rather than through the node tree.
+type SelectorIncludeFilter struct {
+	Path     []string
+	Template string
+	Nindent  int
 }
 
-func detectBaseFromTopMetadataName(content string) (string, error) {
-	lines := strings.Split(content, "\n")
-	kind := ""
-	inMeta := false
-	metaIndent := -1
-	reKind := regexp.MustCompile(`^\s*kind:\s*([A-Za-z0-9]+)\s*$`)
-	reMeta := regexp.MustCompile(`^(\s*)metadata:\s*$`)
-	reName := regexp.MustCompile(`^\s*name:\s*(.+?)\s*$`)
-
-	for i := 0; i < len(lines); i++ {
-		line := lines[i]
-		if m := reKind.FindStringSubmatch(line); m != nil {
-			kind = m[1]
-			inMeta = false
-			metaIndent = -1
+// inject returns the spliced text, the nindent it used, and whether it
+// actually injected anything. Only the last element of Path is matched: the
+// include goes below the first rendered line ending in that key whose block
+// doesn't already contain it, and inject is a no-op if no such line exists.
+func (f *SelectorIncludeFilter) inject(rendered string) (out string, nindent int, injected bool) {
+	key := f.Path[len(f.Path)-1] + ":"
+	lines := strings.Split(rendered, "\n")
+	for i, line := range lines {
+		if !strings.HasSuffix(strings.TrimRight(line, " "), key) {
 			continue
 		}
-		if kind != "Deployment" {
+		blockIndent := countIndent(line) + 2
+		j := i + 1
+		for j < len(lines) && countIndent(lines[j]) >= blockIndent && strings.TrimSpace(lines[j]) != "" {
+			j++
+		}
+		needle := f.Template
+		if p := strings.Index(f.Template, "%"); p > 0 {
+			needle = f.Template[:p]
+		}
+		if strings.Contains(strings.Join(lines[i:j], "\n"), needle) {
 			continue
 		}
-		if !inMeta {
-			if m := reMeta.FindStringSubmatch(line); m != nil {
-				inMeta = true
-				metaIndent = len(m[1])
-				continue
-			}
-		} else {
-			if len(strings.TrimSpace(line)) == 0 {
-				continue
-			}
-			if leadingSpaces(line) <= metaIndent {
-				inMeta = false
-				continue
-			}
-			if leadingSpaces(line) == metaIndent+2 && reName.MatchString(strings.TrimLeft(line, " ")) {
-				m := reName.FindStringSubmatch(strings.TrimLeft(line, " "))
-				val := strings.TrimSpace(m[1])
-				val = strings.Trim(val, `"'`)
-				if strings.Contains(val, "{{") {
-					return "", errors.New("metadata.name already templated; abort base detection")
-				}
-				return val, nil
-			}
+		nindent = f.Nindent
+		if nindent == 0 {
+			nindent = blockIndent
 		}
+		text := f.Template
+		if strings.Contains(text, "%") {
+			text = fmt.Sprintf(f.Template, nindent)
+		}
+		insertion := spaces(blockIndent) + text
+		lines = append(lines[:j], append([]string{insertion}, lines[j:]...)...)
+		return strings.Join(lines, "\n"), nindent, true
 	}
-	return "", errors.New("top-level metadata.name not found for Deployment")
+	return rendered, 0, false
 }
 
-func ensureSelectorInclude(buf bytes.Buffer, nindent int, reInc *regexp.Regexp) bytes.Buffer {
-	s := buf.String()
-	// check tail to avoid duplicate injection
-	tail := s
-	if len(tail) > 800 {
-		tail = tail[len(tail)-800:]
-	}
-	if reInc.MatchString(tail) {
-		return buf
-	}
-	buf.WriteString(fmt.Sprintf(includeSelector, nindent))
-	buf.WriteString("\n")
-	return buf
+// noQuoteScalar builds a scalar node for templating tokens like
+// "{{ $name }}". Style alone can't make kyaml emit these unquoted: go-yaml's
+// plain-scalar rules always quote a value starting with "{", which every
+// token here does. buildFile strips the resulting quotes back out in a
+// post-processing pass (stripTemplateQuotes) once the document is rendered
+// to text, since there's no RNode style that survives the round-trip.
+func noQuoteScalar(value string) *yaml.RNode {
+	n := yaml.NewScalarRNode(value)
+	n.YNode().Style = yaml.Style(0)
+	return n
+}
+
+// templateQuotePattern matches a `{{ ... }}` token the go-yaml encoder has
+// wrapped in single quotes because it starts with "{".
+var templateQuotePattern = regexp.MustCompile(`'(\{\{[^'\n]*\}\})'`)
+
+// stripTemplateQuotes undoes the forced single-quoting go-yaml applies to
+// any plain scalar beginning with "{", restoring the bare `{{ ... }}` tokens
+// noQuoteScalar is meant to produce.
+func stripTemplateQuotes(s string) string {
+	return templateQuotePattern.ReplaceAllString(s, "$1")
 }
 
-func isLabelsKeyLine(line string) bool {
-	trim := strings.TrimSpace(line)
-	return trim == "labels:" || strings.HasSuffix(strings.TrimRight(line, " "), "labels:")
+// hasHeader reports whether content already carries the helper header
+// buildFile prepends on first migration.
+func hasHeader(content string) bool {
+	return strings.Contains(content, `include "auki.nameFor"`)
 }
 
-func isAppLabelLine(line string, expectedIndent int) bool {
-	trim := strings.TrimSpace(line)
-	if !strings.HasPrefix(trim, "app:") {
-		return false
+func detectBase(content string, kinds []string) (string, error) {
+	nodes, err := (&kio.ByteReader{Reader: strings.NewReader(content)}).Read()
+	if err != nil {
+		return "", err
+	}
+	for _, doc := range nodes {
+		kindNode, _ := doc.Pipe(yaml.Lookup("kind"))
+		if kindNode == nil || !contains(kinds, kindNode.YNode().Value) {
+			continue
+		}
+		nameNode, err := doc.Pipe(yaml.Lookup("metadata", "name"))
+		if err != nil || nameNode == nil {
+			return "", fmt.Errorf("top-level metadata.name not found for %s", kindNode.YNode().Value)
+		}
+		val := strings.Trim(nameNode.YNode().Value, `"'`)
+		if strings.Contains(val, "{{") {
+			return "", errors.New("metadata.name already templated; abort base detection")
+		}
+		return val, nil
 	}
-	return leadingSpaces(line) >= expectedIndent
+	return "", fmt.Errorf("no document of a configured kind %v found", kinds)
 }
 
-func leadingSpaces(s string) int { return countIndent(s) }
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
 
 func countIndent(s string) int {
 	i := 0
@@ -323,37 +505,6 @@ func countIndent(s string) int {
 	return i
 }
 
-type scanner struct {
-	lines []string
-	i     int
-	err   error
-}
-
-func newScanner(lines []string) *scanner { return &scanner{lines: lines} }
-func (s *scanner) Scan() bool {
-	if s.i >= len(s.lines) {
-		return false
-	}
-	s.i++
-	return true
-}
-func (s *scanner) Text() string { return s.lines[s.i-1] }
-func (s *scanner) Err() error   { return s.err }
-
-func splitKeepNL(s string) []string {
-	sc := bufio.NewScanner(strings.NewReader(s))
-	sc.Split(bufio.ScanLines)
-	var out []string
-	for sc.Scan() {
-		out = append(out, sc.Text()+"\n")
-	}
-	// preserve no-trailing-newline case
-	if len(s) > 0 && s[len(s)-1] != '\n' && len(out) > 0 {
-		out[len(out)-1] = strings.TrimSuffix(out[len(out)-1], "\n")
-	}
-	return out
-}
-
 func spaces(n int) string {
 	if n <= 0 {
 		return ""
@@ -361,15 +512,59 @@ func spaces(n int) string {
 	return strings.Repeat(" ", n)
 }
 
-func pathOf(stack []keyCtx) string {
-	if len(stack) == 0 {
-		return ""
+// runDryRun builds every file in memory and reports the result per format,
+// touching nothing on disk. In "text" format it prints a unified diff for
+// each file that would actually change; in "json" it prints a single array
+// of RewriteSummary, one per file, changed or not, with Error set for files
+// buildFile couldn't process so CI tooling sees a structured reason instead
+// of a silently dropped entry.
+func runDryRun(files []string, cfg Config, format string) error {
+	var summaries []RewriteSummary
+	failed := false
+
+	for _, f := range files {
+		orig, out, summary, err := buildFile(f, cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR %s: %v\n", f, err)
+			failed = true
+			if format == "json" {
+				summaries = append(summaries, RewriteSummary{File: f, Error: err.Error()})
+			}
+			continue
+		}
+		if format == "json" {
+			summaries = append(summaries, summary)
+			continue
+		}
+		if !summary.Changed {
+			continue
+		}
+		fmt.Print(unifiedDiff(f, string(orig), out))
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(summaries); err != nil {
+			return fmt.Errorf("encode summary: %w", err)
+		}
+	}
+	if failed {
+		return errors.New("dry-run failed for one or more files")
 	}
-	var parts []string
-	for _, c := range stack {
-		parts = append(parts, c.key)
+	return nil
+}
+
+func unifiedDiff(name, a, b string) string {
+	diff := difflib.UnifiedDiff{
+		A:        difflib.SplitLines(a),
+		B:        difflib.SplitLines(b),
+		FromFile: name,
+		ToFile:   name,
+		Context:  3,
 	}
-	return strings.Join(parts, ".")
+	text, _ := difflib.GetUnifiedDiffString(diff)
+	return text
 }
 
 func must(err error) {
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const watchDebounce = 200 * time.Millisecond
+
+// runWatch re-runs processFile on matched files as they change, debouncing
+// bursts of editor-save events. Changes to the config file trigger a reload
+// and a re-run across every currently-matched file.
+func runWatch(root string, cfg Config) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	dirs, err := watchedDirs(root, cfg.Discover)
+	if err != nil {
+		return err
+	}
+	dirs = append(dirs, root)
+	for _, d := range dirs {
+		if err := watcher.Add(d); err != nil {
+			return err
+		}
+	}
+
+	lastRun := map[string]time.Time{}
+	pending := map[string]bool{}
+	configChanged := false
+
+	timer := time.NewTimer(watchDebounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			rel, err := filepath.Rel(root, event.Name)
+			if err != nil {
+				continue
+			}
+			rel = filepath.ToSlash(rel)
+			switch {
+			case filepath.Base(event.Name) == configFileName:
+				configChanged = true
+			case matchesAny(cfg.Discover.Globs, rel) && !matchesAny(cfg.Discover.Excludes, rel):
+				pending[event.Name] = true
+			default:
+				continue
+			}
+			timer.Reset(watchDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("watch: %v", err)
+
+		case <-timer.C:
+			if configChanged {
+				if newCfg, err := loadConfig(root); err != nil {
+					log.Printf("reload config: %v", err)
+				} else {
+					cfg = newCfg
+				}
+				configChanged = false
+				if files, err := discoverFiles(root, cfg.Discover); err != nil {
+					log.Printf("discover: %v", err)
+				} else {
+					for _, f := range files {
+						pending[f] = true
+					}
+				}
+			}
+			for f := range pending {
+				watchProcess(f, cfg, lastRun)
+			}
+			pending = map[string]bool{}
+		}
+	}
+}
+
+// watchedDirs returns the distinct directories containing files matched by
+// cfg, since fsnotify watches directories rather than glob patterns.
+func watchedDirs(root string, cfg DiscoverConfig) ([]string, error) {
+	files, err := discoverFiles(root, cfg)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var dirs []string
+	for _, f := range files {
+		d := filepath.Dir(f)
+		if !seen[d] {
+			seen[d] = true
+			dirs = append(dirs, d)
+		}
+	}
+	return dirs, nil
+}
+
+// watchProcess re-runs processFile on path unless it was already migrated
+// and hasn't changed on disk since the last run. Editing a file past its
+// first migration pass is expected during the developer loop this mode is
+// for, so processFile/buildFile must treat an already-migrated file as a
+// safe no-op rather than erroring.
+func watchProcess(path string, cfg Config, lastRun map[string]time.Time) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if prev, ok := lastRun[path]; ok && !info.ModTime().After(prev) {
+		content, err := os.ReadFile(path)
+		if err == nil && strings.Contains(string(content), `include "auki.nameFor"`) {
+			return
+		}
+	}
+
+	if err := processFile(path, cfg, true); err != nil {
+		log.Printf("ERROR %s: %v", path, err)
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		lastRun[path] = info.ModTime()
+	}
+	log.Printf("updated %s", path)
+}